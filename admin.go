@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const sseInterval = 2 * time.Second
+
+// proxyStatus is one host's target pool health, as returned by /proxies.
+type proxyStatus struct {
+	Host    string         `json:"host"`
+	Targets []TargetHealth `json:"targets"`
+}
+
+// trafficSample is one tick of the /traffic SSE stream: bytes/sec since the
+// previous tick.
+type trafficSample struct {
+	UpBytesPerSec   int64 `json:"up_bytes_per_sec"`
+	DownBytesPerSec int64 `json:"down_bytes_per_sec"`
+}
+
+// AdminServer exposes a Clash-inspired control API on its own listener:
+// live config (hosts/proxies), and observability into in-flight
+// connections and traffic. Every request must carry a bearer token
+// matching ADMIN_TOKEN; with no token configured the API refuses all
+// requests rather than serving unauthenticated.
+type AdminServer struct {
+	server *Server
+	token  string
+}
+
+func NewAdminServer(server *Server) *AdminServer {
+	return &AdminServer{server: server, token: GetEnv("ADMIN_TOKEN", "")}
+}
+
+func (a *AdminServer) authorized(ctx *fasthttp.RequestCtx) bool {
+	if a.token == "" {
+		return false
+	}
+	got := string(ctx.Request.Header.Peek("Authorization"))
+	want := "Bearer " + a.token
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// Handler is the admin listener's request handler.
+func (a *AdminServer) Handler(ctx *fasthttp.RequestCtx) {
+	if !a.authorized(ctx) {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+
+	path := string(ctx.Path())
+	method := string(ctx.Method())
+
+	switch {
+	case method == fasthttp.MethodGet && path == "/proxies":
+		a.handleProxies(ctx)
+	case method == fasthttp.MethodGet && path == "/hosts":
+		a.handleListHosts(ctx)
+	case method == fasthttp.MethodPut && strings.HasPrefix(path, "/hosts/"):
+		a.handleUpsertHost(ctx, strings.TrimPrefix(path, "/hosts/"))
+	case method == fasthttp.MethodGet && path == "/connections":
+		a.handleConnectionsSSE(ctx)
+	case method == fasthttp.MethodDelete && strings.HasPrefix(path, "/connections/"):
+		a.handleCloseConnection(ctx, strings.TrimPrefix(path, "/connections/"))
+	case method == fasthttp.MethodGet && path == "/traffic":
+		a.handleTrafficSSE(ctx)
+	default:
+		ctx.Error("Not Found", fasthttp.StatusNotFound)
+	}
+}
+
+func (a *AdminServer) handleProxies(ctx *fasthttp.RequestCtx) {
+	mappings, err := a.server.store.ListAll(context.Background())
+	if err != nil {
+		ctx.Error("Service Unavailable", fasthttp.StatusServiceUnavailable)
+		logger.Error("admin: listing hosts failed", "err", err)
+		return
+	}
+
+	statuses := make([]proxyStatus, 0, len(mappings))
+	for i := range mappings {
+		m := &mappings[i]
+		balancer := a.server.getBalancer(m.HostURL, m.Strategy, m.FailureThreshold, m.Cooldown)
+		statuses = append(statuses, proxyStatus{Host: m.HostURL, Targets: balancer.Health(m.Targets)})
+	}
+
+	writeJSON(ctx, statuses)
+}
+
+func (a *AdminServer) handleListHosts(ctx *fasthttp.RequestCtx) {
+	mappings, err := a.server.store.ListAll(context.Background())
+	if err != nil {
+		ctx.Error("Service Unavailable", fasthttp.StatusServiceUnavailable)
+		logger.Error("admin: listing hosts failed", "err", err)
+		return
+	}
+
+	redacted := make([]HostMapping, len(mappings))
+	for i, m := range mappings {
+		redacted[i] = redactHostMapping(m)
+	}
+	writeJSON(ctx, redacted)
+}
+
+// redactHostMapping returns a copy of m with its TLS private key blanked, for
+// read-only endpoints like GET /hosts: a "list configs" call should never
+// echo back key material. Raw keys stay write-only via PUT /hosts/{host}.
+func redactHostMapping(m HostMapping) HostMapping {
+	if m.SSL != nil {
+		sslCopy := *m.SSL
+		sslCopy.PrivateKey = ""
+		m.SSL = &sslCopy
+	}
+	return m
+}
+
+func (a *AdminServer) handleUpsertHost(ctx *fasthttp.RequestCtx, host string) {
+	var mapping HostMapping
+	if err := json.Unmarshal(ctx.PostBody(), &mapping); err != nil {
+		ctx.Error("Invalid JSON body", fasthttp.StatusBadRequest)
+		return
+	}
+	mapping.HostURL = host
+
+	if err := a.server.store.Upsert(context.Background(), &mapping); err != nil {
+		ctx.Error("Service Unavailable", fasthttp.StatusServiceUnavailable)
+		logger.Error("admin: upserting host failed", "host", host, "err", err)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+func (a *AdminServer) handleCloseConnection(ctx *fasthttp.RequestCtx, id string) {
+	if err := a.server.connections.Close(id); err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusNotFound)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+func (a *AdminServer) handleConnectionsSSE(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("text/event-stream")
+	ctx.Response.Header.Set("Cache-Control", "no-cache")
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		ticker := time.NewTicker(sseInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			data, err := json.Marshal(a.server.connections.Snapshot())
+			if err != nil {
+				logger.Error("admin: encoding connections snapshot failed", "err", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func (a *AdminServer) handleTrafficSSE(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("text/event-stream")
+	ctx.Response.Header.Set("Cache-Control", "no-cache")
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		ticker := time.NewTicker(sseInterval)
+		defer ticker.Stop()
+
+		intervalSeconds := int64(sseInterval / time.Second)
+		lastUp, lastDown := a.server.connections.Totals()
+		for range ticker.C {
+			up, down := a.server.connections.Totals()
+			sample := trafficSample{
+				UpBytesPerSec:   (up - lastUp) / intervalSeconds,
+				DownBytesPerSec: (down - lastDown) / intervalSeconds,
+			}
+			lastUp, lastDown = up, down
+
+			data, err := json.Marshal(sample)
+			if err != nil {
+				logger.Error("admin: encoding traffic sample failed", "err", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func writeJSON(ctx *fasthttp.RequestCtx, v interface{}) {
+	ctx.SetContentType("application/json")
+	if err := json.NewEncoder(ctx).Encode(v); err != nil {
+		logger.Error("admin: encoding response failed", "err", err)
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultFailureThreshold = 3
+	defaultCooldown         = 30 * time.Second
+	consistentHashVNodes    = 100
+)
+
+var errNoHealthyTargets = errors.New("no healthy targets available")
+
+// Target is one upstream in a HostMapping's pool.
+type Target struct {
+	URL    string `bson:"url" json:"url"`
+	Weight int    `bson:"weight,omitempty" json:"weight,omitempty"`
+}
+
+// Balancer selects a target URL from a pool and tracks the in-flight and
+// health state needed to do so. Implementations are safe for concurrent
+// use and are cached per host by Server.getBalancer so state (active
+// connections, EWMA latency, passive health) accumulates across requests
+// instead of resetting on every call.
+type Balancer interface {
+	// Pick selects a target URL for clientKey (used by hash-based
+	// strategies), excluding targets currently in their failure cooldown.
+	Pick(targets []Target, clientKey string) (string, error)
+	// Release marks a previously picked target's request as finished.
+	Release(target string)
+	// ReportResult feeds the outcome and latency of a completed request
+	// back into the balancer's health/latency tracking.
+	ReportResult(target string, err error, latency time.Duration)
+	// IsOpen reports whether target is currently rejected by the circuit
+	// breaker. Once the cooldown elapses it goes half-open: exactly one
+	// caller is let through as a probe (IsOpen returns false for it, true
+	// for everyone else) until that caller's ReportResult resolves it,
+	// either closing the breaker or reopening it for another cooldown.
+	// Pick can still return an open target when every target in the pool
+	// is down (it fails open rather than refusing to route at all);
+	// callers that want breaker semantics should check IsOpen after Pick
+	// and respond 503 themselves.
+	IsOpen(target string) bool
+	// Health reports the current passive-health/load snapshot for targets.
+	Health(targets []Target) []TargetHealth
+}
+
+// newBalancer builds the Balancer named by strategy, defaulting to
+// round_robin when unset or unrecognized. failureThreshold/cooldown govern
+// the passive health tracking shared by every strategy.
+func newBalancer(strategy string, failureThreshold *int, cooldown *time.Duration) Balancer {
+	threshold := defaultFailureThreshold
+	if failureThreshold != nil {
+		threshold = *failureThreshold
+	}
+	cooldownDuration := defaultCooldown
+	if cooldown != nil {
+		cooldownDuration = *cooldown
+	}
+	tracker := newHealthTracker(threshold, cooldownDuration)
+
+	switch strategy {
+	case "random":
+		return &randomBalancer{baseBalancer{tracker}}
+	case "weighted":
+		return &weightedBalancer{baseBalancer{tracker}}
+	case "ip_hash", "consistent_hash":
+		return &consistentHashBalancer{baseBalancer: baseBalancer{tracker}}
+	case "p2c_ewma":
+		return &p2cEWMABalancer{baseBalancer{tracker}}
+	case "round_robin", "":
+		return &roundRobinBalancer{baseBalancer: baseBalancer{tracker}}
+	default:
+		return &roundRobinBalancer{baseBalancer: baseBalancer{tracker}}
+	}
+}
+
+// clientKey returns the value hash-based balancers key on: the configured
+// header's value if mapping.HashHeader is set and present, otherwise the
+// client's remote IP.
+func clientKey(ctx *fasthttp.RequestCtx, mapping *HostMapping) string {
+	if mapping.HashHeader != "" {
+		if v := ctx.Request.Header.Peek(mapping.HashHeader); len(v) > 0 {
+			return string(v)
+		}
+	}
+	return ctx.RemoteIP().String()
+}
+
+// targetState is the per-target bookkeeping shared by every balancer
+// implementation via healthTracker.
+type targetState struct {
+	activeConns      int
+	consecutiveFails int
+	downUntil        time.Time
+	probing          bool
+	ewmaLatencyMs    float64
+}
+
+// healthTracker holds per-target state (in-flight count, EWMA latency,
+// passive health) keyed by target URL. It is embedded by every Balancer
+// implementation so they share one failure/cooldown policy.
+type healthTracker struct {
+	mu               sync.Mutex
+	states           map[string]*targetState
+	failureThreshold int
+	cooldown         time.Duration
+}
+
+func newHealthTracker(failureThreshold int, cooldown time.Duration) *healthTracker {
+	return &healthTracker{
+		states:           make(map[string]*targetState),
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+	}
+}
+
+// TargetHealth is a point-in-time view of one target's passive health and
+// load, as exposed by the admin API's /proxies endpoint.
+type TargetHealth struct {
+	URL           string  `json:"url"`
+	Healthy       bool    `json:"healthy"`
+	ActiveConns   int     `json:"active_conns"`
+	EWMALatencyMs float64 `json:"ewma_latency_ms"`
+}
+
+func (h *healthTracker) healthSnapshot(targets []Target) []TargetHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	out := make([]TargetHealth, 0, len(targets))
+	for _, t := range targets {
+		st := h.getOrCreate(t.URL)
+		out = append(out, TargetHealth{
+			URL:           t.URL,
+			Healthy:       st.downUntil.IsZero() || now.After(st.downUntil),
+			ActiveConns:   st.activeConns,
+			EWMALatencyMs: st.ewmaLatencyMs,
+		})
+	}
+	return out
+}
+
+func (h *healthTracker) getOrCreate(target string) *targetState {
+	st, ok := h.states[target]
+	if !ok {
+		st = &targetState{}
+		h.states[target] = st
+	}
+	return st
+}
+
+// isOpen reports whether the breaker is currently blocking target, claiming
+// the single half-open probe slot as a side effect when the cooldown has
+// just elapsed. While downUntil is in the future the breaker is fully open
+// and every caller is rejected. Once it has passed, the breaker is
+// half-open: the first caller to observe that (per target) is handed the
+// probe - it gets false (proceed) and st.probing is set so every other
+// concurrent caller still gets true (rejected) until markResult reports the
+// probe's outcome and clears it.
+func (h *healthTracker) isOpen(target string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.getOrCreate(target)
+
+	if st.downUntil.IsZero() {
+		return false
+	}
+	if time.Now().Before(st.downUntil) {
+		return true
+	}
+
+	// Cooldown elapsed: half-open. Only the first caller to see this gets
+	// to probe; everyone else is still rejected until it reports a result.
+	if st.probing {
+		return true
+	}
+	st.probing = true
+	return false
+}
+
+// healthyTargets filters out targets currently in their failure cooldown.
+// If every target is down it fails open and returns the full pool, since
+// serving a request to a possibly-recovered target beats a hard failure.
+func (h *healthTracker) healthyTargets(targets []Target) []Target {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	healthy := make([]Target, 0, len(targets))
+	for _, t := range targets {
+		st := h.getOrCreate(t.URL)
+		if st.downUntil.IsZero() || now.After(st.downUntil) {
+			healthy = append(healthy, t)
+		}
+	}
+	if len(healthy) == 0 {
+		return targets
+	}
+	return healthy
+}
+
+func (h *healthTracker) incConns(target string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.getOrCreate(target).activeConns++
+}
+
+func (h *healthTracker) decConns(target string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.getOrCreate(target).activeConns--
+}
+
+// score is the p2c_ewma selection cost: lower is better, combining recent
+// latency with current load so a fast-but-busy target isn't over-picked.
+func (h *healthTracker) score(target string) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.getOrCreate(target)
+	return st.ewmaLatencyMs * float64(st.activeConns+1)
+}
+
+func (h *healthTracker) markResult(target string, err error, latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.getOrCreate(target)
+
+	if st.ewmaLatencyMs == 0 {
+		st.ewmaLatencyMs = float64(latency.Milliseconds())
+	} else {
+		const alpha = 0.2
+		st.ewmaLatencyMs = alpha*float64(latency.Milliseconds()) + (1-alpha)*st.ewmaLatencyMs
+	}
+
+	st.probing = false
+
+	if err == nil {
+		st.consecutiveFails = 0
+		st.downUntil = time.Time{}
+		return
+	}
+
+	st.consecutiveFails++
+	if st.consecutiveFails >= h.failureThreshold {
+		// Reopens the breaker for another full cooldown, including when
+		// this failure was the half-open probe itself.
+		st.downUntil = time.Now().Add(h.cooldown)
+	}
+}
+
+// baseBalancer gives every Balancer implementation the shared
+// Release/ReportResult behavior backed by a healthTracker; each concrete
+// type only has to implement Pick.
+type baseBalancer struct {
+	*healthTracker
+}
+
+func (b *baseBalancer) Release(target string) {
+	b.decConns(target)
+}
+
+func (b *baseBalancer) ReportResult(target string, err error, latency time.Duration) {
+	b.markResult(target, err, latency)
+}
+
+func (b *baseBalancer) IsOpen(target string) bool {
+	return b.isOpen(target)
+}
+
+func (b *baseBalancer) Health(targets []Target) []TargetHealth {
+	return b.healthSnapshot(targets)
+}
+
+func weightOf(t Target) int {
+	if t.Weight <= 0 {
+		return 1
+	}
+	return t.Weight
+}
+
+// roundRobinBalancer cycles through healthy targets in order.
+type roundRobinBalancer struct {
+	baseBalancer
+	mu      sync.Mutex
+	counter int
+}
+
+func (b *roundRobinBalancer) Pick(targets []Target, _ string) (string, error) {
+	healthy := b.healthyTargets(targets)
+	if len(healthy) == 0 {
+		return "", errNoHealthyTargets
+	}
+
+	b.mu.Lock()
+	idx := b.counter % len(healthy)
+	b.counter++
+	b.mu.Unlock()
+
+	url := healthy[idx].URL
+	b.incConns(url)
+	return url, nil
+}
+
+// randomBalancer picks uniformly at random among healthy targets.
+type randomBalancer struct {
+	baseBalancer
+}
+
+func (b *randomBalancer) Pick(targets []Target, _ string) (string, error) {
+	healthy := b.healthyTargets(targets)
+	if len(healthy) == 0 {
+		return "", errNoHealthyTargets
+	}
+
+	url := healthy[rand.Intn(len(healthy))].URL
+	b.incConns(url)
+	return url, nil
+}
+
+// weightedBalancer picks a healthy target with probability proportional to
+// its configured Weight (defaulting to 1).
+type weightedBalancer struct {
+	baseBalancer
+}
+
+func (b *weightedBalancer) Pick(targets []Target, _ string) (string, error) {
+	healthy := b.healthyTargets(targets)
+	if len(healthy) == 0 {
+		return "", errNoHealthyTargets
+	}
+
+	total := 0
+	for _, t := range healthy {
+		total += weightOf(t)
+	}
+
+	r := rand.Intn(total)
+	for _, t := range healthy {
+		r -= weightOf(t)
+		if r < 0 {
+			b.incConns(t.URL)
+			return t.URL, nil
+		}
+	}
+
+	// Unreachable: r < total and the loop subtracts every weight, so r goes
+	// negative by the last target at the latest. Kept as a final return.
+	url := healthy[len(healthy)-1].URL
+	b.incConns(url)
+	return url, nil
+}
+
+// consistentHashBalancer serves both the "ip_hash" and "consistent_hash"
+// strategies: the client key (IP or configured header) is hashed onto a
+// ring of virtual nodes, which keeps most keys mapped to the same target
+// as the pool grows or shrinks, degenerating to simple hash-based
+// stickiness when the pool size never changes.
+type consistentHashBalancer struct {
+	baseBalancer
+}
+
+func (b *consistentHashBalancer) Pick(targets []Target, clientKey string) (string, error) {
+	healthy := b.healthyTargets(targets)
+	if len(healthy) == 0 {
+		return "", errNoHealthyTargets
+	}
+
+	type ringNode struct {
+		hash uint32
+		url  string
+	}
+	ring := make([]ringNode, 0, len(healthy)*consistentHashVNodes)
+	for _, t := range healthy {
+		for i := 0; i < consistentHashVNodes; i++ {
+			ring = append(ring, ringNode{hash: hashKey(t.URL, i), url: t.URL})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	h := hashKey(clientKey, -1)
+	idx := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if idx == len(ring) {
+		idx = 0
+	}
+
+	url := ring[idx].url
+	b.incConns(url)
+	return url, nil
+}
+
+func hashKey(key string, vnode int) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	if vnode >= 0 {
+		h.Write([]byte{byte(vnode), byte(vnode >> 8)})
+	}
+	return h.Sum32()
+}
+
+// p2cEWMABalancer implements power-of-two-choices: it samples two healthy
+// targets at random and picks the one with the lower
+// (latency * (in-flight + 1)) score, converging toward the least-loaded backend without the coordination
+// cost of checking every target on each pick.
+type p2cEWMABalancer struct {
+	baseBalancer
+}
+
+func (b *p2cEWMABalancer) Pick(targets []Target, _ string) (string, error) {
+	healthy := b.healthyTargets(targets)
+	if len(healthy) == 0 {
+		return "", errNoHealthyTargets
+	}
+	if len(healthy) == 1 {
+		url := healthy[0].URL
+		b.incConns(url)
+		return url, nil
+	}
+
+	i := rand.Intn(len(healthy))
+	j := rand.Intn(len(healthy) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, c := healthy[i], healthy[j]
+	url := a.URL
+	if b.score(c.URL) < b.score(a.URL) {
+		url = c.URL
+	}
+	b.incConns(url)
+	return url, nil
+}
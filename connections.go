@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trackedConnection is one in-flight proxied request or WebSocket tunnel,
+// as exposed by the admin API's /connections endpoint. closer is nil for
+// plain HTTP requests (fasthttp.HostClient gives us no way to abort one
+// mid-flight); WebSocket tunnels set it to the hijacked client connection
+// so DELETE /connections/{id} can force-close them.
+type trackedConnection struct {
+	ID        string    `json:"id"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Target    string    `json:"target"`
+	Start     time.Time `json:"start"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+	closer    io.Closer
+}
+
+// ConnectionTracker registers every in-flight proxied connection so the
+// admin API can enumerate and force-close them, and accumulates total
+// upload/download byte counts for the /traffic endpoint.
+type ConnectionTracker struct {
+	mu    sync.Mutex
+	conns map[string]*trackedConnection
+	seq   uint64
+
+	totalUp   int64
+	totalDown int64
+}
+
+func NewConnectionTracker() *ConnectionTracker {
+	return &ConnectionTracker{conns: make(map[string]*trackedConnection)}
+}
+
+// Register records a new in-flight connection and returns it; call
+// Unregister with its ID once the request/tunnel ends.
+func (t *ConnectionTracker) Register(method, host, target string, closer io.Closer) *trackedConnection {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.seq++
+	conn := &trackedConnection{
+		ID:     fmt.Sprintf("c-%d", t.seq),
+		Method: method,
+		Host:   host,
+		Target: target,
+		Start:  time.Now(),
+		closer: closer,
+	}
+	t.conns[conn.ID] = conn
+	return conn
+}
+
+func (t *ConnectionTracker) Unregister(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, id)
+}
+
+// AddBytes attributes up/down bytes to both the named connection and the
+// tracker's running totals.
+func (t *ConnectionTracker) AddBytes(id string, up, down int64) {
+	t.mu.Lock()
+	if c, ok := t.conns[id]; ok {
+		c.BytesUp += up
+		c.BytesDown += down
+	}
+	t.mu.Unlock()
+
+	atomic.AddInt64(&t.totalUp, up)
+	atomic.AddInt64(&t.totalDown, down)
+}
+
+// Snapshot returns a point-in-time copy of every tracked connection.
+func (t *ConnectionTracker) Snapshot() []trackedConnection {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make([]trackedConnection, 0, len(t.conns))
+	for _, c := range t.conns {
+		out = append(out, *c)
+	}
+	return out
+}
+
+// Close force-closes the named connection's underlying net.Conn. Plain HTTP
+// requests have no closer and return an error rather than being silently
+// ignored.
+func (t *ConnectionTracker) Close(id string) error {
+	t.mu.Lock()
+	c, ok := t.conns[id]
+	t.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("connection %q not found", id)
+	}
+	if c.closer == nil {
+		return fmt.Errorf("connection %q does not support force-close", id)
+	}
+	return c.closer.Close()
+}
+
+// Totals reports cumulative upload/download bytes across every connection
+// this tracker has ever seen.
+func (t *ConnectionTracker) Totals() (up, down int64) {
+	return atomic.LoadInt64(&t.totalUp), atomic.LoadInt64(&t.totalDown)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// logger is the process-wide structured logger. LOG_FORMAT=text switches to
+// a human-readable handler (useful for local development); anything else,
+// including unset, produces JSON so logs can be shipped and queried by
+// field (host, target, request_id, status, ...).
+var logger = newLogger()
+
+func newLogger() *slog.Logger {
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+
+	var handler slog.Handler
+	if GetEnv("LOG_FORMAT", "json") == "text" {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	}
+	return slog.New(handler)
+}
+
+// fatal logs msg and args at error level and exits with status 1, mirroring the old
+// log.Fatalf call sites but through the structured logger.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
@@ -2,26 +2,28 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/fatih/color"
 	"github.com/joho/godotenv"
 	"github.com/valyala/fasthttp"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type SSL struct {
-	PublicKey  string `bson:"public_key"`
-	PrivateKey string `bson:"private_key"`
+	PublicKey  string `bson:"public_key" json:"public_key"`
+	PrivateKey string `bson:"private_key" json:"private_key"`
 }
 
 func GetEnv(key string, default_value string) string {
@@ -33,178 +35,307 @@ func GetEnv(key string, default_value string) string {
 }
 
 type HostMapping struct {
-	HostURL   string         `bson:"host_url"`
-	TargetURL []string       `bson:"target_url"`
-	Timeout   *time.Duration `bson:"timeout,omitempty"`
-	MaxConns  *int           `bson:"max_conns,omitempty"`
-	SSL       *SSL           `bson:"ssl"`
+	HostURL             string         `bson:"host_url" json:"host_url"`
+	Targets             []Target       `bson:"targets" json:"targets"`
+	Rules               []Rule         `bson:"rules,omitempty" json:"rules,omitempty"`
+	Strategy            string         `bson:"strategy,omitempty" json:"strategy,omitempty"`
+	HashHeader          string         `bson:"hash_header,omitempty" json:"hash_header,omitempty"`
+	FailureThreshold    *int           `bson:"failure_threshold,omitempty" json:"failure_threshold,omitempty"`
+	Cooldown            *time.Duration `bson:"cooldown,omitempty" json:"cooldown,omitempty"`
+	Timeout             *time.Duration `bson:"timeout,omitempty" json:"timeout,omitempty"`
+	MaxConns            *int           `bson:"max_conns,omitempty" json:"max_conns,omitempty"`
+	SSL                 *SSL           `bson:"ssl" json:"ssl,omitempty"`
+	AutoTLS             bool           `bson:"auto_tls,omitempty" json:"auto_tls,omitempty"`
+	RedirectHTTPS       *bool          `bson:"redirect_https,omitempty" json:"redirect_https,omitempty"`
+	WSReadTimeout       *time.Duration `bson:"ws_read_timeout,omitempty" json:"ws_read_timeout,omitempty"`
+	WSIdleTimeout       *time.Duration `bson:"ws_idle_timeout,omitempty" json:"ws_idle_timeout,omitempty"`
+	RateLimit           *float64       `bson:"rate_limit,omitempty" json:"rate_limit,omitempty"`
+	RateLimitBurst      *int           `bson:"rate_limit_burst,omitempty" json:"rate_limit_burst,omitempty"`
+	PerIPRateLimit      *float64       `bson:"per_ip_rate_limit,omitempty" json:"per_ip_rate_limit,omitempty"`
+	PerIPRateLimitBurst *int           `bson:"per_ip_rate_limit_burst,omitempty" json:"per_ip_rate_limit_burst,omitempty"`
+	MaxRetries          *int           `bson:"max_retries,omitempty" json:"max_retries,omitempty"`
+	RetryBackoff        *time.Duration `bson:"retry_backoff,omitempty" json:"retry_backoff,omitempty"`
 }
 
-func loadHostMapping(host string) (*HostMapping, error) {
-	clientOptions := options.Client().ApplyURI(GetEnv("MONGO_URL", "mongodb://localhost:27017"))
-	client, err := mongo.Connect(context.Background(), clientOptions)
-	if err != nil {
-		return nil, err
-	}
-	defer client.Disconnect(context.Background())
-	database := client.Database(GetEnv("MONGO_NAME", "api_gateway"))
+type Server struct {
+	store       *MappingStore
+	connections *ConnectionTracker
 
-	hostsCollection := database.Collection("hosts")
-	var mapping HostMapping
-	err = hostsCollection.FindOne(context.Background(), bson.M{"host_url": host}).Decode(&mapping)
-	if err != nil {
-		return nil, err
-	}
+	balancersMux sync.Mutex
+	balancers    map[string]Balancer
 
-	return &mapping, nil
+	limitersMux  sync.Mutex
+	hostLimiters map[string]*tokenBucket
+	ipLimiters   map[string]*tokenBucket
 }
 
-func colorizeStatusCode(statusCode int) string {
-	switch {
-	case statusCode >= 200 && statusCode < 300:
-		return color.New(color.FgGreen).Sprint(statusCode)
-	case statusCode >= 300 && statusCode < 400:
-		return color.New(color.FgBlue).Sprint(statusCode)
-	case statusCode >= 400 && statusCode < 500:
-		return color.New(color.FgYellow).Sprint(statusCode)
-	case statusCode >= 500:
-		return color.New(color.FgRed).Sprint(statusCode)
-	default:
-		return color.New(color.FgWhite).Sprint(statusCode)
+// getBalancer returns the Balancer cached under key, instantiating one with
+// newBalancer(strategy, ...) the first time key is seen. key is the host
+// for mapping-level routing, or host plus the matched rule's key for
+// per-rule target pools, so each rule's health/latency state is tracked
+// independently.
+func (s *Server) getBalancer(key, strategy string, failureThreshold *int, cooldown *time.Duration) Balancer {
+	s.balancersMux.Lock()
+	defer s.balancersMux.Unlock()
+
+	if s.balancers == nil {
+		s.balancers = make(map[string]Balancer)
+	}
+	if b, ok := s.balancers[key]; ok {
+		return b
 	}
-}
 
-type Server struct {
-	ActiveConns    map[string]map[string]int
-	ActiveConnsMux sync.Mutex
+	b := newBalancer(strategy, failureThreshold, cooldown)
+	s.balancers[key] = b
+	return b
 }
 
-func (s *Server) getNextTargetURL(host string) string {
-	s.ActiveConnsMux.Lock()
-	defer s.ActiveConnsMux.Unlock()
-
-	mapping, err := loadHostMapping(host)
-	if err != nil {
-		log.Printf("Error loading host mapping: %s", err)
-		return ""
-	}
-
-	// Check if ActiveConns map is initialized
-	if s.ActiveConns == nil {
-		log.Println("ActiveConns map is nil")
-		s.ActiveConns = make(map[string]map[string]int)
+// invalidateHostCaches drops every balancer and rate limiter cached for
+// host, so a mapping change - via PUT /hosts/{host} or edited directly in
+// Mongo - takes effect on the next request instead of being frozen behind
+// getBalancer/getHostLimiter/getIPLimiter's "first seen wins" caching until
+// a restart. Passed to NewMappingStore as its invalidate hook in main. Balancers and
+// IP limiters are cached per-rule/per-client-IP under keys prefixed with
+// "host#", not just the bare host, so every matching key is dropped too.
+func (s *Server) invalidateHostCaches(host string) {
+	s.balancersMux.Lock()
+	for key := range s.balancers {
+		if key == host || strings.HasPrefix(key, host+"#") {
+			delete(s.balancers, key)
+		}
 	}
+	s.balancersMux.Unlock()
 
-	targetURLs := mapping.TargetURL
-
-	minConns := int(^uint(0) >> 1) // Max int value
-	var targetURL string
-
-	for _, url := range targetURLs {
-		if s.ActiveConns[host] == nil {
-			s.ActiveConns[host] = make(map[string]int)
-		}
-		conns := s.ActiveConns[host][url]
-		if conns < minConns {
-			minConns = conns
-			targetURL = url
+	s.limitersMux.Lock()
+	delete(s.hostLimiters, host)
+	for key := range s.ipLimiters {
+		if key == host || strings.HasPrefix(key, host+"#") {
+			delete(s.ipLimiters, key)
 		}
 	}
-
-	// Increase the active connections count for the selected target
-	s.ActiveConns[host][targetURL]++
-
-	return targetURL
-}
-
-func (s *Server) releaseConnection(host, targetURL string) {
-	s.ActiveConnsMux.Lock()
-	defer s.ActiveConnsMux.Unlock()
-	s.ActiveConns[host][targetURL]--
+	s.limitersMux.Unlock()
 }
 
 func (s *Server) reverseProxyHandler(ctx *fasthttp.RequestCtx) {
+	if string(ctx.Path()) == "/admin/cache/flush" {
+		s.store.Flush()
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+		return
+	}
+
 	host := string(ctx.Host())
+	reqID := requestID(ctx)
 
-	mapping, err := loadHostMapping(host)
+	mapping, router, err := s.store.Get(context.Background(), host)
 	if err != nil {
 		ctx.Error("Service Unavailable", fasthttp.StatusServiceUnavailable)
-		log.Printf("Error loading host mapping: %s", err)
+		logger.Error("loading host mapping failed", "request_id", reqID, "host", host, "err", err)
 		return
 	}
 
-	targetURL := s.getNextTargetURL(host)
-	if targetURL == "" {
-		ctx.Error("Service Unavailable", fasthttp.StatusServiceUnavailable)
+	if !ctx.IsTLS() && mapping.RedirectHTTPS != nil && *mapping.RedirectHTTPS {
+		ctx.Redirect(fmt.Sprintf("https://%s%s", host, ctx.RequestURI()), fasthttp.StatusMovedPermanently)
 		return
 	}
 
-	if !strings.HasPrefix(targetURL, "http://") && !strings.HasPrefix(targetURL, "https://") {
-		if strings.Contains(targetURL, "localhost") {
-			targetURL = "http://" + targetURL
-		} else {
-			targetURL = "https://" + targetURL
+	// A matching rule overrides the mapping's targets/strategy/timeout for
+	// this request; unmatched requests fall back to the mapping-level pool.
+	targets := mapping.Targets
+	strategy := mapping.Strategy
+	timeout := mapping.Timeout
+	balancerKey := host
+
+	var matched *compiledRule
+	if router != nil {
+		matched = router.Match(ctx)
+	}
+	if matched != nil {
+		if len(matched.rule.Targets) > 0 {
+			targets = matched.rule.Targets
+		}
+		if matched.rule.Strategy != "" {
+			strategy = matched.rule.Strategy
 		}
+		if matched.rule.Timeout != nil {
+			timeout = matched.rule.Timeout
+		}
+		balancerKey = host + "#" + matched.key()
 	}
-	target, err := url.Parse(targetURL)
-	if err != nil {
-		ctx.Error("Invalid target URL", fasthttp.StatusInternalServerError)
-		s.releaseConnection(host, targetURL)
-		log.Printf("Error parsing target URL: %s", err)
-		return
+
+	if mapping.RateLimit != nil {
+		limiter := s.getHostLimiter(host, *mapping.RateLimit, intOrDefault(mapping.RateLimitBurst, defaultRateLimitBurst))
+		if !limiter.Allow() {
+			rateLimited(ctx, limiter.retryAfterSeconds())
+			logger.Warn("rate limited", "request_id", reqID, "host", host, "scope", "host")
+			return
+		}
+	}
+	if mapping.PerIPRateLimit != nil {
+		limiter := s.getIPLimiter(host+"#"+ctx.RemoteIP().String(), *mapping.PerIPRateLimit, intOrDefault(mapping.PerIPRateLimitBurst, defaultRateLimitBurst))
+		if !limiter.Allow() {
+			rateLimited(ctx, limiter.retryAfterSeconds())
+			logger.Warn("rate limited", "request_id", reqID, "host", host, "scope", "ip", "remote_ip", ctx.RemoteIP().String())
+			return
+		}
 	}
 
-	defer s.releaseConnection(host, targetURL)
+	balancer := s.getBalancer(balancerKey, strategy, mapping.FailureThreshold, mapping.Cooldown)
+	method := string(ctx.Method())
 
-	// Check if the request is an upgrade to WebSocket by inspecting the Upgrade header
+	// WebSocket upgrades are hijacked and tunneled directly to the upstream
+	// for the lifetime of the connection, so they bypass the retry loop
+	// below; the balancer's bookkeeping is released by proxyWebSocket once
+	// the tunnel closes.
 	if strings.ToLower(string(ctx.Request.Header.Peek("Upgrade"))) == "websocket" {
-		// Respond with HTTP 101 status (Switching Protocols) to indicate WebSocket upgrade
-		ctx.Response.Header.Set("Upgrade", "websocket")
-		ctx.Response.Header.Set("Connection", "Upgrade")
-		ctx.SetStatusCode(fasthttp.StatusSwitchingProtocols)
+		targetURL, err := balancer.Pick(targets, clientKey(ctx, mapping))
+		if err != nil {
+			ctx.Error("Service Unavailable", fasthttp.StatusServiceUnavailable)
+			logger.Error("selecting target failed", "request_id", reqID, "host", host, "err", err)
+			return
+		}
+		targetURL = normalizeTargetURL(targetURL)
+
+		if balancer.IsOpen(targetURL) {
+			balancer.Release(targetURL)
+			ctx.Error("Service Unavailable", fasthttp.StatusServiceUnavailable)
+			logger.Warn("circuit breaker open, rejecting websocket upgrade", "request_id", reqID, "host", host, "target", targetURL)
+			return
+		}
+		s.proxyWebSocket(ctx, balancer, host, targetURL, mapping)
 		return
 	}
 
-	req := &ctx.Request
-	req.SetRequestURI(target.ResolveReference(&url.URL{Path: string(ctx.Path())}).String())
-	req.Header.SetHost(target.Host)
+	maxRetries := defaultMaxRetries
+	if mapping.MaxRetries != nil {
+		maxRetries = *mapping.MaxRetries
+	}
+	backoff := defaultRetryBackoff
+	if mapping.RetryBackoff != nil {
+		backoff = *mapping.RetryBackoff
+	}
 
-	// Copy headers
-	ctx.Request.Header.VisitAll(func(key, value []byte) {
-		req.Header.SetBytesKV(key, value)
-	})
+	for attempt := 0; ; attempt++ {
+		targetURL, err := balancer.Pick(targets, clientKey(ctx, mapping))
+		if err != nil {
+			ctx.Error("Service Unavailable", fasthttp.StatusServiceUnavailable)
+			logger.Error("selecting target failed", "request_id", reqID, "host", host, "err", err)
+			return
+		}
+		targetURL = normalizeTargetURL(targetURL)
+
+		if balancer.IsOpen(targetURL) {
+			balancer.Release(targetURL)
+			if attempt < maxRetries {
+				time.Sleep(retryBackoff(backoff, attempt))
+				continue
+			}
+			ctx.Error("Service Unavailable", fasthttp.StatusServiceUnavailable)
+			logger.Warn("circuit breaker open, retries exhausted", "request_id", reqID, "host", host, "target", targetURL)
+			return
+		}
+
+		target, err := url.Parse(targetURL)
+		if err != nil {
+			ctx.Error("Invalid target URL", fasthttp.StatusInternalServerError)
+			balancer.Release(targetURL)
+			logger.Error("parsing target URL failed", "request_id", reqID, "target", targetURL, "err", err)
+			return
+		}
+
+		path := string(ctx.Path())
+		if matched != nil {
+			path = matched.applyRewrite(path)
+		}
+
+		req := &ctx.Request
+		req.SetRequestURI(target.ResolveReference(&url.URL{Path: path}).String())
+		req.Header.SetHost(target.Host)
+
+		// Copy headers
+		ctx.Request.Header.VisitAll(func(key, value []byte) {
+			req.Header.SetBytesKV(key, value)
+		})
+		if matched != nil {
+			matched.applyRequestHeaders(req)
+		}
+
+		// Handle non-WebSocket HTTP requests using the reverse proxy
+		proxyClient := &fasthttp.HostClient{
+			Addr: target.Host,
+		}
+
+		if mapping.MaxConns != nil {
+			proxyClient.MaxConns = *mapping.MaxConns
+		}
+		if timeout != nil {
+			proxyClient.ReadTimeout = *timeout
+			proxyClient.WriteTimeout = *timeout
+		}
+
+		// Perform the reverse proxy request
+		conn := s.connections.Register(method, host, targetURL, nil)
+		inFlightRequests.WithLabelValues(host, targetURL).Inc()
+
+		start := time.Now()
+		err = proxyClient.Do(req, &ctx.Response)
+		duration := time.Since(start)
+
+		s.connections.AddBytes(conn.ID, int64(len(req.Body())), int64(len(ctx.Response.Body())))
+		s.connections.Unregister(conn.ID)
+		inFlightRequests.WithLabelValues(host, targetURL).Dec()
+		balancer.ReportResult(targetURL, err, duration)
+		requestDuration.WithLabelValues(host, targetURL, method).Observe(duration.Seconds())
+		balancer.Release(targetURL)
+
+		if err != nil {
+			upstreamErrorsTotal.WithLabelValues(host, targetURL).Inc()
+			logger.Error("upstream request failed", "request_id", reqID, "host", host, "target", targetURL, "attempt", attempt, "err", err)
+
+			if attempt < maxRetries && retryable(method, err) {
+				time.Sleep(retryBackoff(backoff, attempt))
+				continue
+			}
+			ctx.Error("Error during request", fasthttp.StatusInternalServerError)
+			return
+		}
+
+		if matched != nil {
+			matched.applyResponseHeaders(&ctx.Response)
+		}
 
-	// Handle non-WebSocket HTTP requests using the reverse proxy
-	proxyClient := &fasthttp.HostClient{
-		Addr: target.Host,
+		statusCode := ctx.Response.StatusCode()
+		requestsTotal.WithLabelValues(host, targetURL, method, strconv.Itoa(statusCode)).Inc()
+		logger.Info("proxied request",
+			"request_id", reqID,
+			"status", statusCode,
+			"duration", duration.String(),
+			"remote_ip", ctx.RemoteIP().String(),
+			"method", method,
+			"target", targetURL,
+			"attempt", attempt,
+			"path", string(ctx.Path()))
+		return
 	}
+}
 
-	if mapping.MaxConns != nil {
-		proxyClient.MaxConns = *mapping.MaxConns
+// normalizeTargetURL prefixes a bare host:port target with a scheme, since
+// HostMapping.Targets store the upstream's host without one.
+func normalizeTargetURL(targetURL string) string {
+	if strings.HasPrefix(targetURL, "http://") || strings.HasPrefix(targetURL, "https://") {
+		return targetURL
 	}
-	if mapping.Timeout != nil {
-		proxyClient.ReadTimeout = *mapping.Timeout
-		proxyClient.WriteTimeout = *mapping.Timeout
+	if strings.Contains(targetURL, "localhost") {
+		return "http://" + targetURL
 	}
+	return "https://" + targetURL
+}
 
-	// Perform the reverse proxy request
-	start := time.Now()
-	if err := proxyClient.Do(req, &ctx.Response); err != nil {
-		log.Printf("Error during request: %s", err)
-		ctx.Error("Error during request", fasthttp.StatusInternalServerError)
-		s.releaseConnection(host, targetURL)
+// intOrDefault returns *v, or fallback if v is nil.
+func intOrDefault(v *int, fallback int) int {
+	if v == nil {
+		return fallback
 	}
-
-	duration := time.Since(start)
-	statusCode := ctx.Response.StatusCode()
-	colorStatusCode := colorizeStatusCode(statusCode)
-	log.Printf("| %s | %s | %s | %s | %s | %s",
-		colorStatusCode,
-		duration,
-		ctx.RemoteIP(),
-		string(ctx.Method()),
-		targetURL,
-		string(ctx.Path()))
+	return *v
 }
 
 func main() {
@@ -215,15 +346,81 @@ func main() {
 		fmt.Println("file .env tidak ditemukan")
 	}
 
+	// server.store is filled in below, once the store exists - but the
+	// store's invalidate hook needs server.invalidateHostCaches wired in
+	// before NewMappingStore starts its change-stream watcher, so that no
+	// event can invalidate a mapping without also invalidating its
+	// balancer/limiter cache. The *Server pointer can be captured by the
+	// hook closure now and dereferenced later; it's only ever read after
+	// main finishes constructing it, well before any request is served.
 	server := &Server{
-		ActiveConns: make(map[string]map[string]int),
+		connections:  NewConnectionTracker(),
+		balancers:    make(map[string]Balancer),
+		hostLimiters: make(map[string]*tokenBucket),
+		ipLimiters:   make(map[string]*tokenBucket),
+	}
+
+	store, err := NewMappingStore(context.Background(), defaultMappingCacheTTL, server.invalidateHostCaches)
+	if err != nil {
+		fatal("connecting to Mongo failed", "err", err)
 	}
+	defer store.Close(context.Background())
+	registerCacheMetrics(store)
+	server.store = store
+
+	go server.sweepIPLimiters()
+
+	admin := NewAdminServer(server)
+	go func() {
+		adminAddr := GetEnv("ADMIN_ADDR", "127.0.0.1:8881")
+		if err := fasthttp.ListenAndServe(adminAddr, admin.Handler); err != nil {
+			fatal("admin ListenAndServe failed", "err", err)
+		}
+	}()
+
+	metricsHandler := fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+	go func() {
+		metricsAddr := GetEnv("METRICS_ADDR", "127.0.0.1:8882")
+		if err := fasthttp.ListenAndServe(metricsAddr, metricsHandler); err != nil {
+			fatal("metrics ListenAndServe failed", "err", err)
+		}
+	}()
 
 	requestHandler := func(ctx *fasthttp.RequestCtx) {
 		server.reverseProxyHandler(ctx)
 	}
 
+	certStore := NewCertStore(store, GetEnv("AUTOCERT_DIR", ""))
+	go func() {
+		if err := serveHTTPS(GetEnv("HTTPS_ADDR", "127.0.0.1:8443"), requestHandler, certStore); err != nil {
+			fatal("HTTPS ListenAndServe failed", "err", err)
+		}
+	}()
+	if certStore.autocert != nil {
+		go func() {
+			if err := http.ListenAndServe(GetEnv("ACME_ADDR", ":80"), certStore.autocert.HTTPHandler(nil)); err != nil {
+				fatal("ACME ListenAndServe failed", "err", err)
+			}
+		}()
+	}
+
 	if err := fasthttp.ListenAndServe("127.0.0.1:8880", requestHandler); err != nil {
-		log.Fatalf("Error in ListenAndServe: %s", err)
+		fatal("ListenAndServe failed", "err", err)
+	}
+}
+
+// serveHTTPS terminates TLS on addr using certStore.GetCertificate to
+// resolve a certificate per SNI hostname, since fasthttp's ServeTLS only
+// supports a single static cert/key file pair.
+func serveHTTPS(addr string, handler fasthttp.RequestHandler, certStore *CertStore) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &fasthttp.Server{
+		Handler:   handler,
+		TLSConfig: &tls.Config{GetCertificate: certStore.GetCertificate},
 	}
+	return srv.Serve(tls.NewListener(ln, srv.TLSConfig))
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_requests_total",
+		Help: "Total proxied HTTP requests, by host, target, method and response status.",
+	}, []string{"host", "target", "method", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_request_duration_seconds",
+		Help:    "Upstream request duration in seconds, by host, target and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host", "target", "method"})
+
+	inFlightRequests = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_in_flight_requests",
+		Help: "In-flight proxied requests, by host and target.",
+	}, []string{"host", "target"})
+
+	upstreamErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_upstream_errors_total",
+		Help: "Upstream request failures (dial, timeout, non-101 upgrade, etc.), by host and target.",
+	}, []string{"host", "target"})
+
+	websocketSessionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_websocket_sessions_total",
+		Help: "WebSocket tunnels successfully established.",
+	})
+
+	tlsHandshakeFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_tls_handshake_failures_total",
+		Help: "TLS handshakes aborted because no certificate could be resolved for the SNI hostname.",
+	})
+)
+
+// registerCacheMetrics exposes store's cumulative hit ratio as a gauge,
+// computed on each scrape rather than tracked incrementally since
+// MappingStore already keeps the raw hit/miss counters.
+func registerCacheMetrics(store *MappingStore) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gateway_mapping_cache_hit_ratio",
+		Help: "Mapping cache hit ratio (hits / (hits + misses)) since startup.",
+	}, func() float64 {
+		hits, misses := store.Stats()
+		total := hits + misses
+		if total == 0 {
+			return 0
+		}
+		return float64(hits) / float64(total)
+	})
+}
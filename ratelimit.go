@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultRateLimitBurst = 1
+	defaultMaxRetries     = 2
+	defaultRetryBackoff   = 100 * time.Millisecond
+
+	ipLimiterIdleTTL       = 10 * time.Minute
+	ipLimiterSweepInterval = 2 * time.Minute
+)
+
+// tokenBucket is a classic token-bucket limiter: tokens refill continuously
+// at rate per second up to burst, and each Allow call spends one.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = defaultRateLimitBurst
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *tokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// idleFor reports how long it has been since this bucket last served an
+// Allow call, as of now. Used by sweepIPLimiters to find buckets to evict.
+func (b *tokenBucket) idleFor(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.last)
+}
+
+// retryAfterSeconds is a minimum wait estimate for a caller that just got
+// rate-limited: how long until one token is available again.
+func (b *tokenBucket) retryAfterSeconds() int {
+	if b.rate <= 0 {
+		return 1
+	}
+	return int(math.Ceil(1 / b.rate))
+}
+
+// getHostLimiter returns the token bucket cached under host, instantiating
+// one with the mapping's configured rate/burst the first time host is seen.
+// Like getBalancer, this state must persist across requests rather than
+// reset on every call, so it's cached on Server.
+func (s *Server) getHostLimiter(host string, rate float64, burst int) *tokenBucket {
+	s.limitersMux.Lock()
+	defer s.limitersMux.Unlock()
+
+	if s.hostLimiters == nil {
+		s.hostLimiters = make(map[string]*tokenBucket)
+	}
+	if b, ok := s.hostLimiters[host]; ok {
+		return b
+	}
+	b := newTokenBucket(rate, burst)
+	s.hostLimiters[host] = b
+	return b
+}
+
+// getIPLimiter returns the per (host, client IP) token bucket cached under
+// key, instantiating one the first time key is seen.
+func (s *Server) getIPLimiter(key string, rate float64, burst int) *tokenBucket {
+	s.limitersMux.Lock()
+	defer s.limitersMux.Unlock()
+
+	if s.ipLimiters == nil {
+		s.ipLimiters = make(map[string]*tokenBucket)
+	}
+	if b, ok := s.ipLimiters[key]; ok {
+		return b
+	}
+	b := newTokenBucket(rate, burst)
+	s.ipLimiters[key] = b
+	return b
+}
+
+// sweepIPLimiters runs for the life of the process, periodically dropping
+// per (host, client IP) token buckets that have sat idle past
+// ipLimiterIdleTTL. Unlike hostLimiters (one entry per configured host) or
+// balancers (also bounded by host/rule count), ipLimiters gets a new entry
+// per distinct client IP ever seen, so without this it grows without bound.
+func (s *Server) sweepIPLimiters() {
+	ticker := time.NewTicker(ipLimiterSweepInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.limitersMux.Lock()
+		for key, b := range s.ipLimiters {
+			if b.idleFor(now) > ipLimiterIdleTTL {
+				delete(s.ipLimiters, key)
+			}
+		}
+		s.limitersMux.Unlock()
+	}
+}
+
+// rateLimited writes a 429 response carrying a Retry-After hint.
+func rateLimited(ctx *fasthttp.RequestCtx, retryAfterSeconds int) {
+	ctx.Response.Header.Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	ctx.Error("Too Many Requests", fasthttp.StatusTooManyRequests)
+}
+
+// retryableMethod reports whether method is safe to retry against a
+// different target without risking a duplicate side effect - idempotent
+// methods only.
+func retryableMethod(method string) bool {
+	switch method {
+	case fasthttp.MethodGet, fasthttp.MethodHead, fasthttp.MethodOptions,
+		fasthttp.MethodPut, fasthttp.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryBackoff returns an exponential backoff duration for the given retry
+// attempt (0-indexed), doubling base each time.
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	return base * time.Duration(1<<uint(attempt))
+}
+
+// beforeBytesWritten reports whether err indicates the upstream request
+// never made it past connection setup - i.e. nothing was written to (or
+// received from) the target, so a retry against a different target can't
+// duplicate a side effect. A HostClient.Do error that occurs after the
+// request was sent doesn't meet this bar and is only retried for
+// idempotent methods.
+func beforeBytesWritten(err error) bool {
+	var dialErr *fasthttp.ErrDialWithUpstream
+	if errors.As(err, &dialErr) {
+		return true
+	}
+	return errors.Is(err, fasthttp.ErrDialTimeout) || errors.Is(err, fasthttp.ErrNoFreeConns)
+}
+
+// retryable reports whether a failed proxy attempt for method may be
+// safely retried against the next target the balancer picks.
+func retryable(method string, err error) bool {
+	return retryableMethod(method) || beforeBytesWritten(err)
+}
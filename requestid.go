@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/valyala/fasthttp"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// requestID returns the inbound X-Request-ID if the client supplied one, or
+// generates a new one. Either way it's set on both the request (so it's
+// propagated upstream) and the response (so the client can correlate its
+// own logs against ours), and is used as the request_id field in
+// structured logs.
+func requestID(ctx *fasthttp.RequestCtx) string {
+	id := string(ctx.Request.Header.Peek(requestIDHeader))
+	if id == "" {
+		id = newRequestID()
+	}
+	ctx.Request.Header.Set(requestIDHeader, id)
+	ctx.Response.Header.Set(requestIDHeader, id)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand.Read only fails if the OS source is broken; fall back
+		// to an all-zero ID rather than panicking on a logging concern.
+		return hex.EncodeToString(b)
+	}
+	return hex.EncodeToString(b)
+}
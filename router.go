@@ -0,0 +1,205 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// HeaderMatch matches a single request header by exact value or regex.
+type HeaderMatch struct {
+	Name   string `bson:"name" json:"name"`
+	Equals string `bson:"equals,omitempty" json:"equals,omitempty"`
+	Regex  string `bson:"regex,omitempty" json:"regex,omitempty"`
+}
+
+// RuleMatch is the set of conditions a request must satisfy for a Rule to
+// apply. Every non-empty field must match; an empty field is ignored.
+type RuleMatch struct {
+	PathPrefix string            `bson:"path_prefix,omitempty" json:"path_prefix,omitempty"`
+	PathRegex  string            `bson:"path_regex,omitempty" json:"path_regex,omitempty"`
+	Method     string            `bson:"method,omitempty" json:"method,omitempty"`
+	Headers    []HeaderMatch     `bson:"headers,omitempty" json:"headers,omitempty"`
+	Query      map[string]string `bson:"query,omitempty" json:"query,omitempty"`
+}
+
+// ReplacePrefix rewrites a path by swapping its From prefix for To.
+type ReplacePrefix struct {
+	From string `bson:"from" json:"from"`
+	To   string `bson:"to" json:"to"`
+}
+
+// Rewrite describes how to transform the outgoing request path. The three
+// forms can be combined; they apply in the order: strip prefix, replace
+// prefix, regex substitution.
+type Rewrite struct {
+	StripPrefix   string         `bson:"strip_prefix,omitempty" json:"strip_prefix,omitempty"`
+	ReplacePrefix *ReplacePrefix `bson:"replace_prefix,omitempty" json:"replace_prefix,omitempty"`
+	RegexMatch    string         `bson:"regex_match,omitempty" json:"regex_match,omitempty"`
+	RegexReplace  string         `bson:"regex_replace,omitempty" json:"regex_replace,omitempty"`
+}
+
+// Rule maps one set of match conditions to its own upstream pool, with an
+// optional rewrite and header injection. A HostMapping with no matching
+// rule falls back to its top-level Targets/Strategy.
+type Rule struct {
+	Name            string            `bson:"name,omitempty" json:"name,omitempty"`
+	Match           RuleMatch         `bson:"match" json:"match"`
+	Targets         []Target          `bson:"targets,omitempty" json:"targets,omitempty"`
+	Strategy        string            `bson:"strategy,omitempty" json:"strategy,omitempty"`
+	Timeout         *time.Duration    `bson:"timeout,omitempty" json:"timeout,omitempty"`
+	Rewrite         *Rewrite          `bson:"rewrite,omitempty" json:"rewrite,omitempty"`
+	RequestHeaders  map[string]string `bson:"request_headers,omitempty" json:"request_headers,omitempty"`
+	ResponseHeaders map[string]string `bson:"response_headers,omitempty" json:"response_headers,omitempty"`
+}
+
+// compiledRule is a Rule with its regexes pre-compiled so Match doesn't pay
+// regexp.Compile on every request.
+type compiledRule struct {
+	rule          Rule
+	index         int
+	pathRegex     *regexp.Regexp
+	headerRegexes map[string]*regexp.Regexp
+	rewriteRegex  *regexp.Regexp
+}
+
+// key identifies this rule for per-rule balancer caching: its Name if set,
+// otherwise its position in the rule list.
+func (cr *compiledRule) key() string {
+	if cr.rule.Name != "" {
+		return cr.rule.Name
+	}
+	return strconv.Itoa(cr.index)
+}
+
+func (cr *compiledRule) matches(ctx *fasthttp.RequestCtx) bool {
+	m := cr.rule.Match
+	path := string(ctx.Path())
+
+	if m.PathPrefix != "" && !strings.HasPrefix(path, m.PathPrefix) {
+		return false
+	}
+	if cr.pathRegex != nil && !cr.pathRegex.MatchString(path) {
+		return false
+	}
+	if m.Method != "" && !strings.EqualFold(string(ctx.Method()), m.Method) {
+		return false
+	}
+	for _, h := range m.Headers {
+		value := string(ctx.Request.Header.Peek(h.Name))
+		if h.Equals != "" && value != h.Equals {
+			return false
+		}
+		if re, ok := cr.headerRegexes[h.Name]; ok && !re.MatchString(value) {
+			return false
+		}
+	}
+	for key, want := range m.Query {
+		if string(ctx.QueryArgs().Peek(key)) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// applyRewrite transforms path per the rule's Rewrite config, in the order
+// strip prefix, replace prefix, regex substitution.
+func (cr *compiledRule) applyRewrite(path string) string {
+	rw := cr.rule.Rewrite
+	if rw == nil {
+		return path
+	}
+
+	if rw.StripPrefix != "" {
+		path = strings.TrimPrefix(path, rw.StripPrefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	if rw.ReplacePrefix != nil && strings.HasPrefix(path, rw.ReplacePrefix.From) {
+		path = rw.ReplacePrefix.To + strings.TrimPrefix(path, rw.ReplacePrefix.From)
+	}
+	if cr.rewriteRegex != nil {
+		path = cr.rewriteRegex.ReplaceAllString(path, rw.RegexReplace)
+	}
+	return path
+}
+
+func (cr *compiledRule) applyRequestHeaders(req *fasthttp.Request) {
+	for k, v := range cr.rule.RequestHeaders {
+		req.Header.Set(k, v)
+	}
+}
+
+func (cr *compiledRule) applyResponseHeaders(resp *fasthttp.Response) {
+	for k, v := range cr.rule.ResponseHeaders {
+		resp.Header.Set(k, v)
+	}
+}
+
+// Router evaluates a HostMapping's rule table in order and returns the
+// first rule matching a given request.
+type Router struct {
+	rules []compiledRule
+}
+
+// compileRouter pre-compiles every regex referenced by mapping.Rules. A
+// rule with an invalid regex is dropped (and logged) rather than failing
+// the whole mapping load.
+func compileRouter(mapping *HostMapping) *Router {
+	compiled := make([]compiledRule, 0, len(mapping.Rules))
+rules:
+	for i, rule := range mapping.Rules {
+		cr := compiledRule{rule: rule, index: i}
+
+		if rule.Match.PathRegex != "" {
+			re, err := regexp.Compile(rule.Match.PathRegex)
+			if err != nil {
+				logger.Warn("router: skipping rule, bad path_regex", "rule", rule.Name, "err", err)
+				continue
+			}
+			cr.pathRegex = re
+		}
+
+		if len(rule.Match.Headers) > 0 {
+			cr.headerRegexes = make(map[string]*regexp.Regexp, len(rule.Match.Headers))
+			for _, h := range rule.Match.Headers {
+				if h.Regex == "" {
+					continue
+				}
+				re, err := regexp.Compile(h.Regex)
+				if err != nil {
+					logger.Warn("router: skipping rule, bad header regex", "rule", rule.Name, "header", h.Name, "err", err)
+					continue rules
+				}
+				cr.headerRegexes[h.Name] = re
+			}
+		}
+
+		if rule.Rewrite != nil && rule.Rewrite.RegexMatch != "" {
+			re, err := regexp.Compile(rule.Rewrite.RegexMatch)
+			if err != nil {
+				logger.Warn("router: skipping rule, bad rewrite regex_match", "rule", rule.Name, "err", err)
+				continue
+			}
+			cr.rewriteRegex = re
+		}
+
+		compiled = append(compiled, cr)
+	}
+	return &Router{rules: compiled}
+}
+
+// Match returns the first rule whose matchers all pass for ctx, or nil if
+// none do.
+func (rt *Router) Match(ctx *fasthttp.RequestCtx) *compiledRule {
+	for i := range rt.rules {
+		if rt.rules[i].matches(ctx) {
+			return &rt.rules[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultMappingCacheTTL = 30 * time.Second
+
+// mappingCacheEntry is one cached HostMapping plus its compiled Router and
+// expiry.
+type mappingCacheEntry struct {
+	mapping   *HostMapping
+	router    *Router
+	expiresAt time.Time
+}
+
+// MappingStore keeps a single long-lived Mongo connection and an in-memory
+// TTL cache of HostMapping documents, so reverseProxyHandler no longer opens
+// and tears down a client on every request. It optionally watches the
+// "hosts" collection so updates invalidate the cache immediately instead of
+// waiting out the TTL.
+type MappingStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+	ttl        time.Duration
+
+	mu      sync.RWMutex
+	entries map[string]*mappingCacheEntry
+
+	invalidateHook func(host string)
+
+	hits   int64
+	misses int64
+}
+
+// NewMappingStore connects to Mongo once, starts a background change-stream
+// watcher (best effort; deployments without change streams, such as a
+// standalone instance, just fall back to TTL-only invalidation), and returns the ready-to-use store. invalidateHook,
+// if non-nil, is wired in before the watcher starts so no change-stream event
+// can race past it and invalidate a host's mapping cache entry without also
+// running the hook.
+func NewMappingStore(ctx context.Context, ttl time.Duration, invalidateHook func(host string)) (*MappingStore, error) {
+	if ttl <= 0 {
+		ttl = defaultMappingCacheTTL
+	}
+
+	clientOptions := options.Client().ApplyURI(GetEnv("MONGO_URL", "mongodb://localhost:27017"))
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &MappingStore{
+		client:         client,
+		collection:     client.Database(GetEnv("MONGO_NAME", "api_gateway")).Collection("hosts"),
+		ttl:            ttl,
+		entries:        make(map[string]*mappingCacheEntry),
+		invalidateHook: invalidateHook,
+	}
+
+	go store.watchChanges(ctx)
+
+	return store, nil
+}
+
+// Get returns the HostMapping for host and its compiled Router, serving from
+// cache when the entry hasn't expired and querying Mongo (then recompiling
+// the router and repopulating the cache) otherwise.
+func (m *MappingStore) Get(ctx context.Context, host string) (*HostMapping, *Router, error) {
+	m.mu.RLock()
+	entry, ok := m.entries[host]
+	m.mu.RUnlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		atomic.AddInt64(&m.hits, 1)
+		return entry.mapping, entry.router, nil
+	}
+	atomic.AddInt64(&m.misses, 1)
+
+	var mapping HostMapping
+	if err := m.collection.FindOne(ctx, bson.M{"host_url": host}).Decode(&mapping); err != nil {
+		return nil, nil, err
+	}
+	router := compileRouter(&mapping)
+
+	m.mu.Lock()
+	m.entries[host] = &mappingCacheEntry{mapping: &mapping, router: router, expiresAt: time.Now().Add(m.ttl)}
+	m.mu.Unlock()
+
+	return &mapping, router, nil
+}
+
+// ListAll returns every HostMapping document, for the admin API's /hosts
+// and /proxies endpoints. It always reads through to Mongo since it's an
+// operator-facing, low-frequency call.
+func (m *MappingStore) ListAll(ctx context.Context) ([]HostMapping, error) {
+	cursor, err := m.collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var mappings []HostMapping
+	if err := cursor.All(ctx, &mappings); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// Upsert writes mapping through to Mongo, keyed by its HostURL, and
+// invalidates any cached entry so the next Get reflects the change
+// immediately rather than waiting for the change stream or TTL. Backs the
+// admin API's PUT /hosts/{host}.
+func (m *MappingStore) Upsert(ctx context.Context, mapping *HostMapping) error {
+	_, err := m.collection.ReplaceOne(ctx, bson.M{"host_url": mapping.HostURL}, mapping, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	m.Invalidate(mapping.HostURL)
+	return nil
+}
+
+// Invalidate drops the cached entry for a single host, if any, and runs the
+// invalidate hook passed to NewMappingStore (if any), with the store's lock
+// released. This fires on every Upsert and on every change-stream update, so
+// callers that keep their own per-host state derived from the mapping -
+// e.g. Server's cached balancers and rate limiters - can drop it too,
+// instead of serving a stale strategy/threshold/rate-limit configuration
+// until the process restarts.
+func (m *MappingStore) Invalidate(host string) {
+	m.mu.Lock()
+	delete(m.entries, host)
+	hook := m.invalidateHook
+	m.mu.Unlock()
+
+	if hook != nil {
+		hook(host)
+	}
+}
+
+// Flush drops every cached entry, forcing the next Get for any host to hit
+// Mongo. Backs the /admin/cache/flush endpoint.
+func (m *MappingStore) Flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = make(map[string]*mappingCacheEntry)
+}
+
+// Stats reports cumulative cache hit/miss counts.
+func (m *MappingStore) Stats() (hits, misses int64) {
+	return atomic.LoadInt64(&m.hits), atomic.LoadInt64(&m.misses)
+}
+
+// Close disconnects the underlying Mongo client.
+func (m *MappingStore) Close(ctx context.Context) error {
+	return m.client.Disconnect(ctx)
+}
+
+// watchChanges subscribes to a change stream on the hosts collection and
+// invalidates the affected host's cache entry as soon as it is updated,
+// inserted, or replaced. Delete events carry no full document and are
+// skipped, so a deleted host's entry stays cached until its TTL expires.
+// If the deployment doesn't support change
+// streams (e.g. a standalone Mongo instance), it logs once and returns,
+// leaving the TTL as the only invalidation mechanism.
+func (m *MappingStore) watchChanges(ctx context.Context) {
+	// SetFullDocument(UpdateLookup) is required for update events: by
+	// default they carry only the delta (updateDescription), so
+	// event.FullDocument.HostURL would decode empty and every update would
+	// be skipped below, leaving invalidation working for inserts/replaces
+	// only.
+	stream, err := m.collection.Watch(ctx, mongo.Pipeline{}, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+	if err != nil {
+		logger.Warn("mapping store: change stream unavailable, relying on TTL only", "err", err)
+		return
+	}
+	defer stream.Close(ctx)
+
+	for stream.Next(ctx) {
+		var event struct {
+			OperationType string      `bson:"operationType"`
+			FullDocument  HostMapping `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&event); err != nil {
+			logger.Error("mapping store: decoding change event failed", "err", err)
+			continue
+		}
+		if event.FullDocument.HostURL == "" {
+			continue
+		}
+		m.Invalidate(event.FullDocument.HostURL)
+		logger.Info("mapping store: invalidated cache", "host", event.FullDocument.HostURL, "operation", event.OperationType)
+	}
+}
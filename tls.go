@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certCacheEntry pairs a parsed certificate with the raw PEM it was built
+// from, so CertStore can tell the underlying Mongo document changed (and
+// reparse) without a separate invalidation channel - it just compares
+// against whatever HostMapping.SSL the (already TTL/change-stream cached)
+// MappingStore hands back.
+type certCacheEntry struct {
+	cert       *tls.Certificate
+	publicKey  string
+	privateKey string
+}
+
+// CertStore resolves per-host TLS certificates for SNI-based termination.
+// Hosts with a populated SSL field get their PEM parsed and cached; hosts
+// with AutoTLS set and no SSL field fall through to an autocert.Manager
+// that issues and renews certificates via ACME.
+type CertStore struct {
+	store    *MappingStore
+	autocert *autocert.Manager
+
+	mu      sync.Mutex
+	entries map[string]*certCacheEntry
+}
+
+// NewCertStore builds a CertStore backed by store. When autocertDir is
+// non-empty, hosts with AutoTLS set and no manual SSL field are issued
+// certificates via ACME, cached as files under that directory.
+func NewCertStore(store *MappingStore, autocertDir string) *CertStore {
+	cs := &CertStore{store: store, entries: make(map[string]*certCacheEntry)}
+	if autocertDir != "" {
+		cs.autocert = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: cs.autocertHostPolicy,
+			Cache:      autocert.DirCache(autocertDir),
+		}
+	}
+	return cs
+}
+
+// autocertHostPolicy only allows ACME issuance for hosts that opted in via
+// AutoTLS and have no manually configured certificate.
+func (cs *CertStore) autocertHostPolicy(ctx context.Context, host string) error {
+	mapping, _, err := cs.store.Get(ctx, host)
+	if err != nil {
+		return fmt.Errorf("unknown host %q: %w", host, err)
+	}
+	if mapping.SSL != nil && mapping.SSL.PublicKey != "" {
+		return fmt.Errorf("host %q has a manual certificate configured", host)
+	}
+	if !mapping.AutoTLS {
+		return fmt.Errorf("host %q is not enrolled in autocert", host)
+	}
+	return nil
+}
+
+// GetCertificate is the tls.Config.GetCertificate callback for the HTTPS
+// listener: it resolves hello.ServerName against the mapping store, returns
+// the matching parsed certificate (reparsing if the underlying PEM
+// changed), and falls back to autocert for AutoTLS-enrolled hosts with no
+// manual certificate.
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := cs.getCertificate(hello)
+	if err != nil {
+		tlsHandshakeFailuresTotal.Inc()
+		logger.Error("TLS handshake aborted", "server_name", hello.ServerName, "err", err)
+	}
+	return cert, err
+}
+
+func (cs *CertStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := hello.ServerName
+	mapping, _, err := cs.store.Get(context.Background(), host)
+	if err != nil {
+		return nil, fmt.Errorf("unknown host %q: %w", host, err)
+	}
+
+	if mapping.SSL == nil || mapping.SSL.PublicKey == "" || mapping.SSL.PrivateKey == "" {
+		if cs.autocert != nil && mapping.AutoTLS {
+			return cs.autocert.GetCertificate(hello)
+		}
+		return nil, fmt.Errorf("host %q has no certificate configured", host)
+	}
+
+	cs.mu.Lock()
+	entry, ok := cs.entries[host]
+	cs.mu.Unlock()
+	if ok && entry.publicKey == mapping.SSL.PublicKey && entry.privateKey == mapping.SSL.PrivateKey {
+		return entry.cert, nil
+	}
+
+	cert, err := tls.X509KeyPair([]byte(mapping.SSL.PublicKey), []byte(mapping.SSL.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate for %q: %w", host, err)
+	}
+
+	cs.mu.Lock()
+	cs.entries[host] = &certCacheEntry{cert: &cert, publicKey: mapping.SSL.PublicKey, privateKey: mapping.SSL.PrivateKey}
+	cs.mu.Unlock()
+
+	return &cert, nil
+}
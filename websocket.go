@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultWSHandshakeTimeout = 10 * time.Second
+	defaultWSIdleTimeout      = 60 * time.Second
+)
+
+// proxyWebSocket hijacks the client connection and tunnels it to the
+// upstream, forwarding the client's upgrade request verbatim and relaying
+// the upstream's 101 response before copying raw bytes in both directions
+// until either side closes. targetURL has already been scheme-normalized
+// and picked (and counted as in-flight) by balancer; this function is
+// responsible for releasing it once the tunnel ends.
+func (s *Server) proxyWebSocket(ctx *fasthttp.RequestCtx, balancer Balancer, host, targetURL string, mapping *HostMapping) {
+	reqID := requestID(ctx)
+	start := time.Now()
+
+	upstreamConn, err := dialUpstream(targetURL, mapping)
+	if err != nil {
+		balancer.ReportResult(targetURL, err, time.Since(start))
+		balancer.Release(targetURL)
+		upstreamErrorsTotal.WithLabelValues(host, targetURL).Inc()
+		ctx.Error("Bad Gateway", fasthttp.StatusBadGateway)
+		logger.Error("ws: dial upstream failed", "request_id", reqID, "target", targetURL, "err", err)
+		return
+	}
+
+	if err := writeUpgradeRequest(upstreamConn, ctx, targetURL); err != nil {
+		upstreamConn.Close()
+		balancer.ReportResult(targetURL, err, time.Since(start))
+		balancer.Release(targetURL)
+		upstreamErrorsTotal.WithLabelValues(host, targetURL).Inc()
+		ctx.Error("Bad Gateway", fasthttp.StatusBadGateway)
+		logger.Error("ws: writing upgrade request failed", "request_id", reqID, "target", targetURL, "err", err)
+		return
+	}
+
+	statusLine, headerLines, upstreamReader, err := readUpstreamHandshake(upstreamConn, defaultWSHandshakeTimeout)
+	if err != nil {
+		upstreamConn.Close()
+		balancer.ReportResult(targetURL, err, time.Since(start))
+		balancer.Release(targetURL)
+		upstreamErrorsTotal.WithLabelValues(host, targetURL).Inc()
+		ctx.Error("Bad Gateway", fasthttp.StatusBadGateway)
+		logger.Error("ws: reading upstream handshake failed", "request_id", reqID, "target", targetURL, "err", err)
+		return
+	}
+	if !strings.Contains(statusLine, "101") {
+		upstreamConn.Close()
+		balancer.ReportResult(targetURL, fmt.Errorf("upstream refused websocket upgrade: %s", statusLine), time.Since(start))
+		balancer.Release(targetURL)
+		upstreamErrorsTotal.WithLabelValues(host, targetURL).Inc()
+		ctx.Error("Upgrade Failed", fasthttp.StatusBadGateway)
+		logger.Error("ws: upstream refused upgrade", "request_id", reqID, "target", targetURL, "status_line", statusLine)
+		return
+	}
+
+	// The handshake succeeded: report success now, using dial+handshake
+	// latency, so the breaker's passive health reflects WS-only failures
+	// instead of only ever seeing the non-WS retry loop's results. The
+	// eventual tunnel teardown (errCh below) isn't itself a health signal -
+	// a client or idle-timeout close is normal, not an upstream failure.
+	balancer.ReportResult(targetURL, nil, time.Since(start))
+
+	idleTimeout := defaultWSIdleTimeout
+	if mapping.WSIdleTimeout != nil {
+		idleTimeout = *mapping.WSIdleTimeout
+	}
+	readTimeout := idleTimeout
+	if mapping.WSReadTimeout != nil {
+		readTimeout = *mapping.WSReadTimeout
+	}
+
+	// Without this, fasthttp writes ctx.Response (an empty 200) to the
+	// socket before invoking the hijack callback, corrupting the handshake
+	// ahead of the 101 response written below.
+	ctx.HijackSetNoResponse(true)
+	ctx.Hijack(func(clientConn net.Conn) {
+		defer balancer.Release(targetURL)
+		defer upstreamConn.Close()
+
+		// clientConn is passed as the closer so the admin API's
+		// DELETE /connections/{id} can force-close this tunnel.
+		conn := s.connections.Register(string(ctx.Method()), host, targetURL, clientConn)
+		defer s.connections.Unregister(conn.ID)
+
+		if _, err := io.WriteString(clientConn, statusLine+"\r\n"+headerLines+"\r\n"); err != nil {
+			logger.Error("ws: writing handshake to client failed", "request_id", reqID, "target", targetURL, "err", err)
+			return
+		}
+
+		websocketSessionsTotal.Inc()
+		inFlightRequests.WithLabelValues(host, targetURL).Inc()
+		defer inFlightRequests.WithLabelValues(host, targetURL).Dec()
+
+		errCh := make(chan error, 2)
+		// upstreamReader wraps upstreamConn and may still hold handshake
+		// trailing bytes buffered by bufio.Reader; read through it rather
+		// than upstreamConn directly so nothing is dropped.
+		go copyWithDeadline(clientConn, &deadlineReader{Conn: upstreamConn, r: upstreamReader}, readTimeout, errCh,
+			func(n int) { s.connections.AddBytes(conn.ID, 0, int64(n)) })
+		go copyWithDeadline(upstreamConn, clientConn, readTimeout, errCh,
+			func(n int) { s.connections.AddBytes(conn.ID, int64(n), 0) })
+
+		if err := <-errCh; err != nil && err != io.EOF {
+			logger.Info("ws: tunnel closed", "request_id", reqID, "host", host, "target", targetURL, "err", err)
+		}
+	})
+}
+
+// dialUpstream opens a TCP (or TLS, for https targets) connection to the
+// already scheme-normalized targetURL.
+func dialUpstream(targetURL string, mapping *HostMapping) (net.Conn, error) {
+	target, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, err
+	}
+
+	dialTimeout := defaultWSHandshakeTimeout
+	if mapping.Timeout != nil {
+		dialTimeout = *mapping.Timeout
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+
+	addr := target.Host
+	if target.Scheme == "https" {
+		if !strings.Contains(addr, ":") {
+			addr += ":443"
+		}
+		return tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: target.Hostname()})
+	}
+
+	if !strings.Contains(addr, ":") {
+		addr += ":80"
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// writeUpgradeRequest forwards the client's upgrade request line and headers
+// to the upstream connection verbatim, including Sec-WebSocket-* headers and
+// subprotocols, and appends X-Forwarded-* headers.
+func writeUpgradeRequest(conn net.Conn, ctx *fasthttp.RequestCtx, targetURL string) error {
+	target, err := url.Parse(targetURL)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", ctx.Method(), ctx.URI().RequestURI())
+	fmt.Fprintf(&b, "Host: %s\r\n", target.Host)
+	ctx.Request.Header.VisitAll(func(key, value []byte) {
+		if strings.EqualFold(string(key), "Host") {
+			return
+		}
+		fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+	})
+	fmt.Fprintf(&b, "X-Forwarded-For: %s\r\n", ctx.RemoteIP())
+	fmt.Fprintf(&b, "X-Forwarded-Proto: %s\r\n", ctx.URI().Scheme())
+	fmt.Fprintf(&b, "X-Forwarded-Host: %s\r\n", ctx.Host())
+	b.WriteString("\r\n")
+
+	_, err = io.WriteString(conn, b.String())
+	return err
+}
+
+// readUpstreamHandshake reads the status line and header block of the
+// upstream's HTTP response, stopping at the blank line that terminates the
+// headers. The bufio.Reader used to do so is returned so any bytes it has
+// already buffered past the headers (the start of the first WS frame) are
+// not lost once the connection switches to raw copying.
+func readUpstreamHandshake(conn net.Conn, timeout time.Duration) (statusLine string, headerLines string, r *bufio.Reader, err error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r = bufio.NewReader(conn)
+	statusLine, err = r.ReadString('\n')
+	if err != nil {
+		return "", "", nil, err
+	}
+	statusLine = strings.TrimRight(statusLine, "\r\n")
+
+	var headers strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", "", nil, err
+		}
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+		headers.WriteString(line)
+	}
+	return statusLine, headers.String(), r, nil
+}
+
+// deadlineReader reads through a bufio.Reader (which may still hold bytes
+// buffered past the handshake) while delegating deadlines, writes, and
+// close to the underlying connection.
+type deadlineReader struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (d *deadlineReader) Read(b []byte) (int, error) {
+	return d.r.Read(b)
+}
+
+// copyWithDeadline relays bytes from src to dst, resetting src's read
+// deadline after every successful read so idleTimeout bounds inactivity
+// rather than total connection lifetime. A zero idleTimeout disables the
+// deadline. onBytes, if non-nil, is called with the byte count of each
+// successful write, for traffic accounting.
+func copyWithDeadline(dst io.Writer, src net.Conn, idleTimeout time.Duration, errCh chan<- error, onBytes func(n int)) {
+	buf := make([]byte, 32*1024)
+	for {
+		if idleTimeout > 0 {
+			src.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				errCh <- werr
+				return
+			}
+			if onBytes != nil {
+				onBytes(n)
+			}
+		}
+		if err != nil {
+			errCh <- err
+			return
+		}
+	}
+}
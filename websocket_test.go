@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestCopyWithDeadlinePingPong verifies a clean round trip: bytes written on
+// one end of a pipe are relayed verbatim, in order, and a graceful close of
+// the source yields io.EOF on errCh rather than an error.
+func TestCopyWithDeadlinePingPong(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	var dst bytes.Buffer
+	errCh := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		copyWithDeadline(&dst, server, time.Second, errCh, nil)
+		close(done)
+	}()
+
+	ping := []byte{0x89, 0x00} // WS ping frame: FIN + opcode 0x9, zero-length payload
+	pong := []byte{0x8A, 0x00} // WS pong frame: FIN + opcode 0xA, zero-length payload
+	if _, err := client.Write(ping); err != nil {
+		t.Fatalf("write ping: %v", err)
+	}
+	if _, err := client.Write(pong); err != nil {
+		t.Fatalf("write pong: %v", err)
+	}
+	client.Close()
+
+	select {
+	case err := <-errCh:
+		if err != io.EOF {
+			t.Fatalf("errCh = %v, want io.EOF after a graceful close", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for copyWithDeadline to observe the closed connection")
+	}
+	<-done
+
+	want := append(append([]byte{}, ping...), pong...)
+	if got := dst.Bytes(); !bytes.Equal(got, want) {
+		t.Fatalf("relayed bytes = %x, want %x", got, want)
+	}
+}
+
+// erroringConn is a net.Conn stand-in whose Read always fails with a fixed
+// error, simulating an abnormal closure (e.g. a reset connection) rather
+// than the graceful io.EOF a clean close produces.
+type erroringConn struct {
+	net.Conn
+	err error
+}
+
+func (c *erroringConn) Read([]byte) (int, error)        { return 0, c.err }
+func (c *erroringConn) SetReadDeadline(time.Time) error { return nil }
+
+// TestCopyWithDeadlineAbnormalClose verifies that a non-EOF read error (an
+// abnormal closure) is propagated through errCh unmodified, so callers like
+// proxyWebSocket can tell it apart from a graceful shutdown.
+func TestCopyWithDeadlineAbnormalClose(t *testing.T) {
+	sentinel := errors.New("connection reset by peer")
+	src := &erroringConn{err: sentinel}
+	var dst bytes.Buffer
+	errCh := make(chan error, 1)
+
+	copyWithDeadline(&dst, src, time.Second, errCh, nil)
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, sentinel) {
+			t.Fatalf("errCh = %v, want %v", err, sentinel)
+		}
+	default:
+		t.Fatal("expected copyWithDeadline to report an error on errCh")
+	}
+}